@@ -0,0 +1,142 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	hdfs "github.com/colinmarc/hdfs/protocol/hadoop_hdfs"
+	"github.com/golang/protobuf/proto"
+)
+
+// blockReadStream implements io.Reader over the data section of a
+// BlockOpResponseProto: a sequence of packets, each carrying a
+// PacketHeaderProto, one CRC per chunk, and the chunk data itself, as
+// Hadoop's DataTransferProtocol lays it out on the wire. It verifies every
+// chunk's checksum as it's read, returning a *ChecksumError on a mismatch
+// (rather than a plain error) so BlockReader can drive ChecksumMode and
+// CorruptionObserver off it exactly like the short-circuit read path does.
+type blockReadStream struct {
+	r           io.Reader
+	chunkSize   int
+	checksumTab *crc32.Table
+
+	// offset is the absolute offset, within the block, of the next chunk to
+	// be verified. It starts at the chunk-aligned offset the datanode's
+	// first packet is built around (ReadOpChecksumInfoProto.ChunkOffset),
+	// and advances by chunkSize (or less, for a final short chunk) as
+	// chunks are consumed, so a ChecksumError can be attributed to the
+	// right place in the block.
+	offset int64
+
+	data        []byte
+	lastInBlock bool
+}
+
+// newBlockReadStream wraps r — the raw data-transfer connection, positioned
+// just past the datanode's BlockOpResponseProto — as a chunk-verified
+// io.Reader. offset is the block offset the response's first packet is
+// aligned to.
+func newBlockReadStream(r io.Reader, chunkSize int, checksumTab *crc32.Table, offset int64) *blockReadStream {
+	return &blockReadStream{r: r, chunkSize: chunkSize, checksumTab: checksumTab, offset: offset}
+}
+
+// Read implements io.Reader.
+func (s *blockReadStream) Read(b []byte) (int, error) {
+	for len(s.data) == 0 {
+		if s.lastInBlock {
+			return 0, io.EOF
+		}
+
+		if err := s.readPacket(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+// A data packet on the wire:
+// +-------------------------------------------------------------------+
+// |  Packet Length, 4 bytes (this field's own 4 bytes + checksums +    |
+// |  data, not counting the header that follows it)                    |
+// +-------------------------------------------------------------------+
+// |  Header Length, 2 bytes                                            |
+// +-------------------------------------------------------------------+
+// |  PacketHeaderProto, Header Length bytes                            |
+// +-------------------------------------------------------------------+
+// |  One CRC per chunk, 4 bytes each                                   |
+// +-------------------------------------------------------------------+
+// |  Chunk data                                                        |
+// +-------------------------------------------------------------------+
+//
+// readPacket reads and verifies the next one, appending its data to s.data
+// (or, for the header-only packet that signals the end of the block,
+// setting s.lastInBlock instead).
+func (s *blockReadStream) readPacket() error {
+	var packetLen uint32
+	if err := binary.Read(s.r, binary.BigEndian, &packetLen); err != nil {
+		return err
+	}
+
+	var headerLen uint16
+	if err := binary.Read(s.r, binary.BigEndian, &headerLen); err != nil {
+		return err
+	}
+
+	headerBytes := make([]byte, headerLen)
+	if _, err := io.ReadFull(s.r, headerBytes); err != nil {
+		return err
+	}
+
+	header := &hdfs.PacketHeaderProto{}
+	if err := proto.Unmarshal(headerBytes, header); err != nil {
+		return err
+	}
+
+	dataLen := int(header.GetDataLen())
+
+	checksumLen := int(packetLen) - 4 - dataLen
+	if checksumLen < 0 {
+		return fmt.Errorf("rpc: invalid packet: length %d too small for %d bytes of data", packetLen, dataLen)
+	}
+
+	checksums := make([]byte, checksumLen)
+	if _, err := io.ReadFull(s.r, checksums); err != nil {
+		return err
+	}
+
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return err
+	}
+
+	numChunks := (dataLen + s.chunkSize - 1) / s.chunkSize
+	for i := 0; i < numChunks; i++ {
+		start := i * s.chunkSize
+		end := start + s.chunkSize
+		if end > dataLen {
+			end = dataLen
+		}
+		chunk := data[start:end]
+
+		chunkOffset := s.offset
+		s.offset += int64(len(chunk))
+
+		if (i+1)*4 > len(checksums) {
+			return fmt.Errorf("rpc: packet is missing a checksum for chunk %d", i)
+		}
+
+		want := binary.BigEndian.Uint32(checksums[i*4 : i*4+4])
+		if crc32.Checksum(chunk, s.checksumTab) != want {
+			return &ChecksumError{ChunkOffset: chunkOffset}
+		}
+	}
+
+	s.data = data
+	s.lastInBlock = header.GetLastPacketInBlock()
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"time"
 
 	hdfs "github.com/colinmarc/hdfs/protocol/hadoop_hdfs"
 	"github.com/golang/protobuf/proto"
@@ -19,27 +20,83 @@ import (
 type BlockReader struct {
 	block     *hdfs.LocatedBlockProto
 	datanodes *datanodeFailover
-	stream    *blockReadStream
+	stream    io.Reader
 	conn      net.Conn
 	offset    int64
 	closed    bool
+
+	// currentAddress is the "ip:port" of the datanode br.stream is
+	// currently reading from, tracked so a checksum mismatch can be
+	// attributed to the right replica.
+	currentAddress string
+
+	// selector ordered the datanodes at construction time; connectNext
+	// also feeds it per-attempt latency if it implements LatencyObserver.
+	selector DatanodeSelector
+
+	// ShortCircuit, if set, makes connectNext attempt a short-circuit local
+	// read (bypassing the TCP data-transfer path) against any replica that
+	// looks co-located with the client, before falling back to the normal
+	// path.
+	ShortCircuit *ShortCircuitConfig
+
+	// Protection, if set, requires connectNext to negotiate SASL
+	// DIGEST-MD5 encryption on the data-transfer connection before
+	// issuing the block read request, for use against clusters with
+	// dfs.encrypt.data.transfer (or dfs.data.transfer.protection) enabled.
+	Protection DataTransferProtection
+
+	// ChecksumMode controls how a checksum mismatch is handled; it
+	// defaults to ChecksumVerify. Namenode is only consulted when it's
+	// ChecksumVerifyAndReportCorrupt, and CorruptionObserver in every mode
+	// except ChecksumSkip.
+	ChecksumMode ChecksumMode
+
+	// CorruptionObserver, if set, is called whenever a checksum mismatch
+	// is detected, unless ChecksumMode is ChecksumSkip.
+	CorruptionObserver CorruptionObserver
+
+	// Namenode is used to report a corrupt replica back to the cluster
+	// when ChecksumMode is ChecksumVerifyAndReportCorrupt.
+	Namenode NamenodeClient
 }
 
 // NewBlockReader returns a new BlockReader, given the block information and
 // security token from the namenode. It will connect (lazily) to one of the
 // provided datanode locations based on which datanodes have seen failures.
 func NewBlockReader(block *hdfs.LocatedBlockProto, offset int64) *BlockReader {
+	return newBlockReader(block, offset, defaultSelector{})
+}
+
+// NewBlockReaderWithSelector is like NewBlockReader, but uses selector to
+// order the block's datanode replicas instead of trying them in whatever
+// order the namenode returned. This is useful on multi-rack clusters, or
+// when some datanodes are known to be chronically slow.
+func NewBlockReaderWithSelector(block *hdfs.LocatedBlockProto, offset int64, selector DatanodeSelector) *BlockReader {
+	return newBlockReader(block, offset, selector)
+}
+
+func newBlockReader(block *hdfs.LocatedBlockProto, offset int64, selector DatanodeSelector) *BlockReader {
 	locs := block.GetLocs()
-	datanodes := make([]string, len(locs))
+	candidates := make([]DatanodeCandidate, len(locs))
 	for i, loc := range locs {
 		dn := loc.GetId()
-		datanodes[i] = fmt.Sprintf("%s:%d", dn.GetIpAddr(), dn.GetXferPort())
+		candidates[i] = DatanodeCandidate{
+			Address:  fmt.Sprintf("%s:%d", dn.GetIpAddr(), dn.GetXferPort()),
+			Hostname: dn.GetHostName(),
+			IPAddr:   dn.GetIpAddr(),
+		}
+	}
+
+	if selector == nil {
+		selector = defaultSelector{}
 	}
 
 	return &BlockReader{
 		block:     block,
-		datanodes: newDatanodeFailover(datanodes),
+		datanodes: newDatanodeFailover(selector.Order(candidates)),
 		offset:    offset,
+		selector:  selector,
 	}
 }
 
@@ -62,6 +119,13 @@ func (br *BlockReader) Read(b []byte) (int, error) {
 
 	// This is the main retry loop.
 	for br.stream != nil || br.datanodes.numRemaining() > 0 {
+		// A concurrent Close (e.g. from a ConcurrentBlockReader tearing
+		// down an in-flight chunk) should stop retries immediately,
+		// rather than failing over through every remaining datanode.
+		if br.closed {
+			return 0, io.ErrClosedPipe
+		}
+
 		// First, we try to connect. If this fails, we can just skip the datanode
 		// and continue.
 		if br.stream == nil {
@@ -78,6 +142,9 @@ func (br *BlockReader) Read(b []byte) (int, error) {
 		br.offset += int64(n)
 		if err != nil && err != io.EOF {
 			br.stream = nil
+			if cerr, ok := err.(*ChecksumError); ok && br.ChecksumMode != ChecksumSkip {
+				br.handleChecksumError(cerr)
+			}
 			br.datanodes.recordFailure(err)
 			if n > 0 {
 				return n, nil
@@ -97,9 +164,89 @@ func (br *BlockReader) Read(b []byte) (int, error) {
 	return 0, err
 }
 
+// WriteTo implements io.WriterTo.
+//
+// It's equivalent to copying from br in a loop, but since it writes
+// checksum-verified chunks from the underlying blockReadStream directly to
+// w, it avoids the extra copy through a caller-supplied buffer that Read
+// requires. Like Read, it transparently fails over to another datanode if
+// the current one disconnects mid-transfer.
+//
+// A write to w is never treated as a datanode fault: WriteTo copies the
+// stream manually rather than via io.Copy precisely so that a failing w
+// (a full disk, a closed pipe) is returned to the caller immediately,
+// instead of being funneled into the failover loop and retried against
+// every remaining replica.
+func (br *BlockReader) WriteTo(w io.Writer) (int64, error) {
+	if br.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	buf := make([]byte, 32*1024)
+	var written int64
+
+readLoop:
+	for br.stream != nil || br.datanodes.numRemaining() > 0 {
+		if br.closed {
+			return written, io.ErrClosedPipe
+		}
+
+		if br.stream == nil {
+			err := br.connectNext()
+			if err != nil {
+				br.datanodes.recordFailure(err)
+				continue
+			}
+		}
+
+		for {
+			n, err := br.stream.Read(buf)
+			if n > 0 {
+				wn, werr := w.Write(buf[:n])
+				written += int64(wn)
+				br.offset += int64(wn)
+				if werr != nil {
+					return written, werr
+				}
+				if wn < n {
+					return written, io.ErrShortWrite
+				}
+			}
+
+			if err != nil {
+				if err == io.EOF {
+					break readLoop
+				}
+
+				br.stream = nil
+				if cerr, ok := err.(*ChecksumError); ok && br.ChecksumMode != ChecksumSkip {
+					br.handleChecksumError(cerr)
+				}
+				br.datanodes.recordFailure(err)
+				continue readLoop
+			}
+		}
+	}
+
+	if uint64(br.offset) >= br.block.GetB().GetNumBytes() {
+		br.Close()
+		return written, nil
+	}
+
+	err := br.datanodes.lastError()
+	if err == nil {
+		err = errors.New("No available datanodes for block.")
+	}
+
+	return written, err
+}
+
 // Close implements io.Closer.
 func (br *BlockReader) Close() error {
 	br.closed = true
+	if closer, ok := br.stream.(io.Closer); ok {
+		closer.Close()
+	}
 	if br.conn != nil {
 		br.conn.Close()
 	}
@@ -111,12 +258,34 @@ func (br *BlockReader) Close() error {
 // connects to it.
 func (br *BlockReader) connectNext() error {
 	address := br.datanodes.next()
+	br.currentAddress = address
+
+	if br.ShortCircuit != nil {
+		stream, conn, err := br.attemptShortCircuit(address)
+		if err == nil {
+			br.stream = stream
+			br.conn = conn
+			return nil
+		} else if err != errShortCircuitSkipped {
+			return err
+		}
+		// Not applicable to this datanode; fall back to the normal TCP path.
+	}
+
+	connectStart := time.Now()
 
 	conn, err := net.DialTimeout("tcp", address, connectionTimeout)
 	if err != nil {
 		return err
 	}
 
+	if br.Protection != "" {
+		conn, err = negotiateDataTransferEncryption(conn, br.block, br.Protection)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = br.writeBlockReadRequest(conn)
 	if err != nil {
 		return err
@@ -127,6 +296,13 @@ func (br *BlockReader) connectNext() error {
 		return err
 	}
 
+	// readBlockReadResponse only returns once the datanode's first bytes
+	// (its response header) have arrived, so this is a connect-plus-
+	// first-byte latency sample, same as LatencyAwareSelector expects.
+	if observer, ok := br.selector.(LatencyObserver); ok {
+		observer.Observe(address, time.Since(connectStart).Seconds())
+	}
+
 	readInfo := resp.GetReadOpChecksumInfo()
 	checksumInfo := readInfo.GetChecksum()
 
@@ -142,7 +318,7 @@ func (br *BlockReader) connectNext() error {
 	}
 
 	chunkSize := int(checksumInfo.GetBytesPerChecksum())
-	stream := newBlockReadStream(conn, chunkSize, checksumTab)
+	stream := newBlockReadStream(conn, chunkSize, checksumTab, int64(readInfo.GetChunkOffset()))
 
 	// The read will start aligned to a chunk boundary, so we need to seek forward
 	// to the requested offset.
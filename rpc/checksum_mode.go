@@ -0,0 +1,116 @@
+package rpc
+
+import (
+	"fmt"
+
+	hdfs "github.com/colinmarc/hdfs/protocol/hadoop_hdfs"
+	"github.com/golang/protobuf/proto"
+)
+
+// ChecksumMode controls how BlockReader reacts to a checksum mismatch
+// detected while streaming a block.
+type ChecksumMode int
+
+const (
+	// ChecksumVerify fails over to another replica on a mismatch, same as
+	// BlockReader's long-standing default, without reporting anything back
+	// to the namenode.
+	ChecksumVerify ChecksumMode = iota
+
+	// ChecksumVerifyAndReportCorrupt does everything ChecksumVerify does,
+	// and also reports the offending replica to the namenode via
+	// reportBadBlocks, so the cluster can re-replicate the block away from
+	// it. The report is sent as soon as the mismatch is detected, before
+	// BlockReader connects to another replica; it does not wait for
+	// failover to succeed.
+	ChecksumVerifyAndReportCorrupt
+
+	// ChecksumSkip turns off the CorruptionObserver hook and namenode
+	// reporting. It does not turn off verification: chunks are still
+	// checked as they're read, and a mismatch still makes BlockReader fail
+	// over to another replica.
+	ChecksumSkip
+)
+
+// ChecksumError is returned by the underlying block stream when a chunk's
+// CRC doesn't match the value the datanode sent alongside it. BlockReader
+// treats it like any other stream error for the purposes of failover, but
+// also uses it to drive ChecksumMode's reporting behavior and the
+// CorruptionObserver hook, distinguishing a local, recoverable bitrot
+// event from a dropped connection.
+type ChecksumError struct {
+	ChunkOffset int64
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("rpc: checksum mismatch at chunk offset %d", e.ChunkOffset)
+}
+
+// CorruptBlock describes a checksum mismatch BlockReader detected on a
+// replica, for use with a CorruptionObserver.
+type CorruptBlock struct {
+	Block       *hdfs.ExtendedBlockProto
+	DatanodeID  *hdfs.DatanodeIDProto
+	ChunkOffset int64
+}
+
+// CorruptionObserver is called whenever BlockReader detects a checksum
+// mismatch on a chunk, as soon as it drops the offending replica's stream
+// and before it connects to another one. It fires in every ChecksumMode
+// except ChecksumSkip, so applications can log or emit metrics for a
+// mismatch even when they don't also want it reported to the namenode.
+type CorruptionObserver func(CorruptBlock)
+
+// NamenodeClient is the subset of the client-namenode protocol BlockReader
+// needs in order to report a corrupt replica.
+type NamenodeClient interface {
+	ReportBadBlocks(blocks []*hdfs.LocatedBlockProto) error
+}
+
+// handleChecksumError runs the CorruptionObserver and, if ChecksumMode is
+// ChecksumVerifyAndReportCorrupt, reports the replica BlockReader just
+// dropped to the namenode. It runs before BlockReader connects to another
+// replica.
+func (br *BlockReader) handleChecksumError(cerr *ChecksumError) {
+	loc := br.locationFor(br.currentAddress)
+
+	corrupt := CorruptBlock{
+		Block:       br.block.GetB(),
+		DatanodeID:  loc.GetId(),
+		ChunkOffset: cerr.ChunkOffset,
+	}
+
+	if br.CorruptionObserver != nil {
+		br.CorruptionObserver(corrupt)
+	}
+
+	if br.ChecksumMode == ChecksumVerifyAndReportCorrupt && br.Namenode != nil && loc != nil {
+		// Scope the report to just the replica that failed its checksum,
+		// not every location the block has; reporting the whole
+		// LocatedBlockProto would tell the namenode all of them are bad.
+		bad := &hdfs.LocatedBlockProto{
+			B:          br.block.GetB(),
+			Offset:     br.block.Offset,
+			Locs:       []*hdfs.DatanodeInfoProto{loc},
+			BlockToken: br.block.GetBlockToken(),
+			Corrupt:    proto.Bool(true),
+		}
+
+		// Best-effort: a failure to report this replica isn't surfaced;
+		// the read goes on to the next replica either way.
+		_ = br.Namenode.ReportBadBlocks([]*hdfs.LocatedBlockProto{bad})
+	}
+}
+
+// locationFor looks up the DatanodeInfoProto for one of the block's
+// replicas by its "ip:port" address.
+func (br *BlockReader) locationFor(address string) *hdfs.DatanodeInfoProto {
+	for _, loc := range br.block.GetLocs() {
+		dn := loc.GetId()
+		if fmt.Sprintf("%s:%d", dn.GetIpAddr(), dn.GetXferPort()) == address {
+			return loc
+		}
+	}
+
+	return nil
+}
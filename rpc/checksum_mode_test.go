@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"testing"
+
+	hdfs "github.com/colinmarc/hdfs/protocol/hadoop_hdfs"
+	"github.com/golang/protobuf/proto"
+)
+
+type fakeNamenodeClient struct {
+	reported [][]*hdfs.LocatedBlockProto
+	err      error
+}
+
+func (f *fakeNamenodeClient) ReportBadBlocks(blocks []*hdfs.LocatedBlockProto) error {
+	f.reported = append(f.reported, blocks)
+	return f.err
+}
+
+func testBlockWithTwoReplicas() *hdfs.LocatedBlockProto {
+	return &hdfs.LocatedBlockProto{
+		B:      &hdfs.ExtendedBlockProto{BlockId: proto.Uint64(1), NumBytes: proto.Uint64(128)},
+		Offset: proto.Uint64(0),
+		Locs: []*hdfs.DatanodeInfoProto{
+			{Id: &hdfs.DatanodeIDProto{IpAddr: proto.String("10.0.0.1"), XferPort: proto.Uint32(50010)}},
+			{Id: &hdfs.DatanodeIDProto{IpAddr: proto.String("10.0.0.2"), XferPort: proto.Uint32(50010)}},
+		},
+	}
+}
+
+func TestHandleChecksumErrorNotifiesObserver(t *testing.T) {
+	var observed *CorruptBlock
+	br := &BlockReader{
+		block:          testBlockWithTwoReplicas(),
+		currentAddress: "10.0.0.2:50010",
+		ChecksumMode:   ChecksumVerify,
+		CorruptionObserver: func(c CorruptBlock) {
+			observed = &c
+		},
+	}
+
+	br.handleChecksumError(&ChecksumError{ChunkOffset: 64})
+
+	if observed == nil {
+		t.Fatal("CorruptionObserver was not called")
+	}
+	if observed.ChunkOffset != 64 {
+		t.Errorf("ChunkOffset = %d, want 64", observed.ChunkOffset)
+	}
+	if got := observed.DatanodeID.GetIpAddr(); got != "10.0.0.2" {
+		t.Errorf("DatanodeID.IpAddr = %q, want %q", got, "10.0.0.2")
+	}
+}
+
+func TestHandleChecksumErrorSkipsReportWhenModeIsVerify(t *testing.T) {
+	nn := &fakeNamenodeClient{}
+	br := &BlockReader{
+		block:          testBlockWithTwoReplicas(),
+		currentAddress: "10.0.0.1:50010",
+		ChecksumMode:   ChecksumVerify,
+		Namenode:       nn,
+	}
+
+	br.handleChecksumError(&ChecksumError{ChunkOffset: 0})
+
+	if len(nn.reported) != 0 {
+		t.Errorf("ReportBadBlocks was called %d times, want 0", len(nn.reported))
+	}
+}
+
+func TestHandleChecksumErrorReportsOnlyFailingReplica(t *testing.T) {
+	nn := &fakeNamenodeClient{}
+	br := &BlockReader{
+		block:          testBlockWithTwoReplicas(),
+		currentAddress: "10.0.0.1:50010",
+		ChecksumMode:   ChecksumVerifyAndReportCorrupt,
+		Namenode:       nn,
+	}
+
+	br.handleChecksumError(&ChecksumError{ChunkOffset: 0})
+
+	if len(nn.reported) != 1 {
+		t.Fatalf("ReportBadBlocks was called %d times, want 1", len(nn.reported))
+	}
+
+	reported := nn.reported[0]
+	if len(reported) != 1 {
+		t.Fatalf("reported %d blocks, want 1", len(reported))
+	}
+	if locs := reported[0].GetLocs(); len(locs) != 1 {
+		t.Fatalf("reported block has %d locations, want 1 (just the failing replica)", len(locs))
+	} else if got := locs[0].GetId().GetIpAddr(); got != "10.0.0.1" {
+		t.Errorf("reported replica = %q, want %q", got, "10.0.0.1")
+	}
+}
+
+func TestLocationForUnknownAddress(t *testing.T) {
+	br := &BlockReader{block: testBlockWithTwoReplicas()}
+
+	if loc := br.locationFor("10.0.0.9:50010"); loc != nil {
+		t.Errorf("locationFor returned %v for an address not among the block's replicas, want nil", loc)
+	}
+}
@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// newTestConcurrentBlockReader builds a ConcurrentBlockReader with its
+// results already populated, bypassing start() (and the real datanode
+// connections it would otherwise require) so Read's delivery logic can be
+// exercised directly.
+func newTestConcurrentBlockReader(results ...chunkResult) *ConcurrentBlockReader {
+	cbr := &ConcurrentBlockReader{
+		started: true,
+		done:    make(chan struct{}),
+		active:  make(map[*BlockReader]struct{}),
+	}
+	cbr.results = make([]chan chunkResult, len(results))
+	for i, res := range results {
+		cbr.results[i] = make(chan chunkResult, 1)
+		cbr.results[i] <- res
+	}
+
+	return cbr
+}
+
+func TestConcurrentBlockReaderDeliversChunksInOrder(t *testing.T) {
+	cbr := newTestConcurrentBlockReader(
+		chunkResult{data: []byte("hello ")},
+		chunkResult{data: []byte("world")},
+	)
+
+	got, err := ioutil.ReadAll(cbr)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	if want := "hello world"; string(got) != want {
+		t.Errorf("ReadAll() = %q, want %q", got, want)
+	}
+}
+
+func TestConcurrentBlockReaderSurfacesChunkError(t *testing.T) {
+	wantErr := errors.New("no available datanodes for chunk")
+	cbr := newTestConcurrentBlockReader(
+		chunkResult{data: []byte("ok")},
+		chunkResult{err: wantErr},
+	)
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(cbr, buf); err != nil {
+		t.Fatalf("reading first (good) chunk: %s", err)
+	}
+
+	_, err := cbr.Read(buf)
+	if err != wantErr {
+		t.Errorf("Read() error = %v, want %v", err, wantErr)
+	}
+}
+
+func TestConcurrentBlockReaderReadAfterCloseReturnsErrClosedPipe(t *testing.T) {
+	cbr := newTestConcurrentBlockReader(chunkResult{data: []byte("x")})
+	if err := cbr.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if _, err := cbr.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("Read() after Close() error = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestConcurrentBlockReaderCloseStopsInFlightWorkers(t *testing.T) {
+	cbr := &ConcurrentBlockReader{
+		started: true,
+		done:    make(chan struct{}),
+		active:  make(map[*BlockReader]struct{}),
+	}
+
+	// Stand in for a BlockReader a worker currently has an in-flight fetch
+	// on; Close should tear it down directly, same as it would for a real
+	// worker blocked inside io.ReadFull.
+	inFlight := &BlockReader{}
+	cbr.mu.Lock()
+	cbr.active[inFlight] = struct{}{}
+	cbr.mu.Unlock()
+
+	if err := cbr.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	select {
+	case <-cbr.done:
+	default:
+		t.Error("Close did not close the done channel, so queued/in-flight workers would never stop")
+	}
+
+	if !inFlight.closed {
+		t.Error("Close did not close the in-flight BlockReader")
+	}
+
+	// Close must be idempotent: a second call shouldn't try to close
+	// cbr.done again and panic.
+	if err := cbr.Close(); err != nil {
+		t.Fatalf("second Close: %s", err)
+	}
+}
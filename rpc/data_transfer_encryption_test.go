@@ -0,0 +1,136 @@
+package rpc
+
+import (
+	"io"
+	"net"
+	"regexp"
+	"testing"
+)
+
+func TestParseDigestParams(t *testing.T) {
+	challenge := []byte(`realm="0",nonce="abc123",qop="auth,auth-conf",charset=utf-8,cipher="3des,rc4"`)
+	got := parseDigestParams(challenge)
+
+	want := map[string]string{
+		"realm":   "0",
+		"nonce":   "abc123",
+		"qop":     "auth,auth-conf",
+		"charset": "utf-8",
+		"cipher":  "3des,rc4",
+	}
+
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("params[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+var digestResponseRE = regexp.MustCompile(`^username="alice",realm="0",nonce="abc123",cnonce="[0-9a-f]{32}",nc=00000001,qop=(\S+?),digest-uri="hdfs/0",response=[0-9a-f]{32}(,cipher=(\S+))?,charset=utf-8$`)
+
+func TestDigestMD5RespondAuth(t *testing.T) {
+	challenge := []byte(`realm="0",nonce="abc123"`)
+
+	resp, sessionKey, err := digestMD5Respond(challenge, "alice", "secret", "auth")
+	if err != nil {
+		t.Fatalf("digestMD5Respond: %s", err)
+	}
+	if len(sessionKey) == 0 {
+		t.Fatal("digestMD5Respond returned an empty session key")
+	}
+
+	m := digestResponseRE.FindStringSubmatch(string(resp))
+	if m == nil {
+		t.Fatalf("response %q doesn't match expected format", resp)
+	}
+	if m[1] != "auth" {
+		t.Errorf("qop = %q, want %q", m[1], "auth")
+	}
+	if m[3] != "" {
+		t.Errorf("response unexpectedly included cipher=%s for qop=auth", m[3])
+	}
+}
+
+func TestDigestMD5RespondAuthConfIncludesCipher(t *testing.T) {
+	challenge := []byte(`realm="0",nonce="abc123",cipher="3des,rc4"`)
+
+	resp, _, err := digestMD5Respond(challenge, "alice", "secret", "auth-conf")
+	if err != nil {
+		t.Fatalf("digestMD5Respond: %s", err)
+	}
+
+	m := digestResponseRE.FindStringSubmatch(string(resp))
+	if m == nil {
+		t.Fatalf("response %q doesn't match expected format", resp)
+	}
+	if m[3] != "rc4" {
+		t.Errorf("cipher = %q, want %q", m[3], "rc4")
+	}
+}
+
+func TestDigestMD5RespondAuthConfRequiresRC4Offer(t *testing.T) {
+	challenge := []byte(`realm="0",nonce="abc123",cipher="3des"`)
+
+	if _, _, err := digestMD5Respond(challenge, "alice", "secret", "auth-conf"); err == nil {
+		t.Fatal("digestMD5Respond succeeded even though the server didn't offer rc4")
+	}
+}
+
+func TestDigestMD5RespondRequiresNonce(t *testing.T) {
+	challenge := []byte(`realm="0"`)
+
+	if _, _, err := digestMD5Respond(challenge, "alice", "secret", "auth"); err == nil {
+		t.Fatal("digestMD5Respond succeeded with no nonce in the challenge")
+	}
+}
+
+func TestQopMACDeterministicAndSequenceSensitive(t *testing.T) {
+	key := []byte("session-key")
+	data := []byte("some message")
+
+	mac1 := qopMAC(key, 0, data)
+	mac2 := qopMAC(key, 0, data)
+	if string(mac1) != string(mac2) {
+		t.Error("qopMAC is not deterministic for identical inputs")
+	}
+
+	mac3 := qopMAC(key, 1, data)
+	if string(mac1) == string(mac3) {
+		t.Error("qopMAC did not change when the sequence number changed")
+	}
+}
+
+func TestQopConnRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sessionKey := []byte("shared-session-key")
+	cWrite, err := newQopConn(client, sessionKey, true, false)
+	if err != nil {
+		t.Fatalf("newQopConn (client): %s", err)
+	}
+	sRead, err := newQopConn(server, sessionKey, true, true)
+	if err != nil {
+		t.Fatalf("newQopConn (server): %s", err)
+	}
+
+	msg := []byte("the quick brown fox")
+	done := make(chan error, 1)
+	go func() {
+		_, werr := cWrite.Write(msg)
+		done <- werr
+	}()
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(sRead, buf); err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	if string(buf) != string(msg) {
+		t.Errorf("round-tripped message = %q, want %q", buf, msg)
+	}
+}
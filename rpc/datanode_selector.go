@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// DatanodeCandidate describes one replica location available for a block
+// read, along with the locality hints a DatanodeSelector might use to rank
+// it.
+type DatanodeCandidate struct {
+	// Address is the "ip:port" the datanode's xfer service listens on, and
+	// is what BlockReader actually dials.
+	Address string
+
+	// Hostname is the datanode's advertised hostname, if any.
+	Hostname string
+
+	// IPAddr is the datanode's advertised IP address.
+	IPAddr string
+}
+
+// DatanodeSelector orders a block's datanode replicas before BlockReader
+// tries them. Implementations can use locality, latency history, or any
+// other signal to produce a try-list; BlockReader still falls over to the
+// next entry in the list (and consults the global failure cache) if a
+// given datanode turns out to be unreachable.
+type DatanodeSelector interface {
+	// Order returns the addresses of candidates, in the order BlockReader
+	// should attempt them.
+	Order(candidates []DatanodeCandidate) []string
+}
+
+// LatencyObserver is implemented by selectors that want connectNext to
+// feed back the connect-plus-first-byte latency of each attempt, such as
+// LatencyAwareSelector. BlockReader checks for it after every successful
+// connection.
+type LatencyObserver interface {
+	// Observe records a latency sample, in seconds, for a connection
+	// attempt to address.
+	Observe(address string, latencySeconds float64)
+}
+
+// defaultSelector preserves whatever order the namenode returned the
+// replicas in, which is the behavior BlockReader has always had.
+type defaultSelector struct{}
+
+func (defaultSelector) Order(candidates []DatanodeCandidate) []string {
+	addrs := make([]string, len(candidates))
+	for i, c := range candidates {
+		addrs[i] = c.Address
+	}
+
+	return addrs
+}
+
+// RandomSelector shuffles the replicas on every call, which spreads read
+// load evenly across them instead of always preferring the first one the
+// namenode listed.
+type RandomSelector struct{}
+
+func (RandomSelector) Order(candidates []DatanodeCandidate) []string {
+	addrs := make([]string, len(candidates))
+	for i, c := range candidates {
+		addrs[i] = c.Address
+	}
+
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+
+	return addrs
+}
+
+// LocalityFirstSelector prefers datanodes that are co-located with the
+// client, falling back to the namenode's original order for the rest.
+type LocalityFirstSelector struct {
+	// LocalHostname and LocalIPAddr are compared against each candidate's
+	// Hostname and IPAddr; a match is tried first.
+	LocalHostname string
+	LocalIPAddr   string
+}
+
+func (s LocalityFirstSelector) Order(candidates []DatanodeCandidate) []string {
+	var local, remote []string
+	for _, c := range candidates {
+		if (s.LocalHostname != "" && c.Hostname == s.LocalHostname) ||
+			(s.LocalIPAddr != "" && c.IPAddr == s.LocalIPAddr) {
+			local = append(local, c.Address)
+		} else {
+			remote = append(remote, c.Address)
+		}
+	}
+
+	return append(local, remote...)
+}
+
+// LatencyAwareSelector keeps an exponentially-weighted moving average of
+// connect-plus-first-byte latency for each datanode it's seen, and orders
+// candidates fastest-first. Datanodes it has no latency sample for yet are
+// tried before ones known to be slow, so they get a chance to establish a
+// baseline.
+type LatencyAwareSelector struct {
+	// Decay is the EWMA smoothing factor applied by Observe, in (0, 1]. A
+	// smaller value weighs history more heavily; a larger value reacts
+	// faster to recent samples. It defaults to 0.2.
+	Decay float64
+
+	mu    sync.Mutex
+	ewmas map[string]float64
+}
+
+// Observe records a connect-plus-first-byte latency sample for address,
+// folding it into that datanode's running EWMA.
+func (s *LatencyAwareSelector) Observe(address string, latencySeconds float64) {
+	decay := s.Decay
+	if decay <= 0 {
+		decay = 0.2
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ewmas == nil {
+		s.ewmas = make(map[string]float64)
+	}
+
+	if prev, ok := s.ewmas[address]; ok {
+		s.ewmas[address] = decay*latencySeconds + (1-decay)*prev
+	} else {
+		s.ewmas[address] = latencySeconds
+	}
+}
+
+func (s *LatencyAwareSelector) Order(candidates []DatanodeCandidate) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]string, len(candidates))
+	for i, c := range candidates {
+		addrs[i] = c.Address
+	}
+
+	// Candidates with no latency sample yet sort before ones with a known
+	// EWMA, so a stable sort leaves them in the namenode's original order
+	// while known-slow datanodes sink to the back.
+	known := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		_, known[a] = s.ewmas[a]
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		a, b := addrs[i], addrs[j]
+		if known[a] != known[b] {
+			return known[b]
+		}
+
+		return s.ewmas[a] < s.ewmas[b]
+	})
+
+	return addrs
+}
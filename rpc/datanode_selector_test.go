@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultSelectorOrder(t *testing.T) {
+	candidates := []DatanodeCandidate{
+		{Address: "10.0.0.1:50010"},
+		{Address: "10.0.0.2:50010"},
+	}
+
+	got := defaultSelector{}.Order(candidates)
+	want := []string{"10.0.0.1:50010", "10.0.0.2:50010"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+}
+
+func TestLocalityFirstSelectorOrder(t *testing.T) {
+	candidates := []DatanodeCandidate{
+		{Address: "10.0.0.1:50010", Hostname: "remote-1"},
+		{Address: "10.0.0.2:50010", Hostname: "local-host"},
+		{Address: "10.0.0.3:50010", IPAddr: "10.0.0.3"},
+	}
+
+	s := LocalityFirstSelector{LocalHostname: "local-host"}
+	got := s.Order(candidates)
+	want := []string{"10.0.0.2:50010", "10.0.0.1:50010", "10.0.0.3:50010"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+}
+
+func TestLocalityFirstSelectorMatchesByIPAddr(t *testing.T) {
+	candidates := []DatanodeCandidate{
+		{Address: "10.0.0.1:50010", IPAddr: "10.0.0.1"},
+		{Address: "10.0.0.2:50010", IPAddr: "10.0.0.2"},
+	}
+
+	s := LocalityFirstSelector{LocalIPAddr: "10.0.0.2"}
+	got := s.Order(candidates)
+	want := []string{"10.0.0.2:50010", "10.0.0.1:50010"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+}
+
+func TestLatencyAwareSelectorUnknownBeforeKnown(t *testing.T) {
+	s := &LatencyAwareSelector{}
+	s.Observe("10.0.0.1:50010", 0.5)
+
+	candidates := []DatanodeCandidate{
+		{Address: "10.0.0.1:50010"},
+		{Address: "10.0.0.2:50010"},
+	}
+
+	got := s.Order(candidates)
+	want := []string{"10.0.0.2:50010", "10.0.0.1:50010"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v (unknown datanodes should sort first)", got, want)
+	}
+}
+
+func TestLatencyAwareSelectorOrdersByEWMA(t *testing.T) {
+	s := &LatencyAwareSelector{}
+	s.Observe("slow:50010", 1.0)
+	s.Observe("fast:50010", 0.1)
+
+	candidates := []DatanodeCandidate{
+		{Address: "slow:50010"},
+		{Address: "fast:50010"},
+	}
+
+	got := s.Order(candidates)
+	want := []string{"fast:50010", "slow:50010"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+}
+
+func TestLatencyAwareSelectorObserveDecaysTowardNewSamples(t *testing.T) {
+	s := &LatencyAwareSelector{Decay: 0.5}
+	s.Observe("a:50010", 1.0)
+	s.Observe("a:50010", 0.0)
+
+	s.mu.Lock()
+	got := s.ewmas["a:50010"]
+	s.mu.Unlock()
+
+	if want := 0.5; got != want {
+		t.Errorf("ewma after second Observe = %v, want %v", got, want)
+	}
+}
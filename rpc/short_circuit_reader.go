@@ -0,0 +1,315 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	hdfs "github.com/colinmarc/hdfs/protocol/hadoop_hdfs"
+	"github.com/golang/protobuf/proto"
+)
+
+// requestShortCircuitFdsOp is the DataTransferProtocol op code for asking a
+// co-located datanode for a block's file descriptors directly, instead of
+// streaming it over TCP.
+const requestShortCircuitFdsOp = 0x57
+
+// ShortCircuitConfig enables short-circuit local reads. When the datanode
+// serving a replica is co-located with the client, BlockReader can ask it,
+// over a Unix domain socket, for the block file's descriptors directly
+// (REQUEST_SHORT_CIRCUIT_FDS) instead of streaming the block over TCP. The
+// client then reads the block file itself, still verifying each chunk
+// against the replica's .meta file, which avoids an extra copy through the
+// datanode's network stack entirely.
+type ShortCircuitConfig struct {
+	// SocketPathTemplate is the datanode's domain socket path, with the
+	// literal string "_PORT" replaced by the datanode's data-transfer
+	// port, mirroring Hadoop's dfs.domain.socket.path convention, e.g.
+	// "/var/lib/hadoop-hdfs/dn_socket._PORT".
+	SocketPathTemplate string
+
+	// LocalAddresses lists the IP addresses that identify this host. A
+	// replica is only attempted short-circuit if its datanode's IP address
+	// matches one of these; everything else uses the normal TCP path.
+	// Hostnames are not compared.
+	LocalAddresses []string
+}
+
+// errShortCircuitSkipped is returned by attemptShortCircuit when
+// short-circuit reads aren't applicable to a given datanode (it's not
+// local, or it has no domain socket), as opposed to when they were
+// attempted and failed. connectNext treats the two differently: a skip
+// falls back to TCP silently, while a failure is a real connection error.
+var errShortCircuitSkipped = errors.New("rpc: short-circuit read not applicable to this datanode")
+
+func (c *ShortCircuitConfig) isLocal(address string) bool {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+
+	for _, local := range c.LocalAddresses {
+		if local == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *ShortCircuitConfig) socketPath(address string) (string, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Replace(c.SocketPathTemplate, "_PORT", port, 1), nil
+}
+
+// attemptShortCircuit tries to open the block directly through a
+// co-located datanode's domain socket. It returns errShortCircuitSkipped,
+// without having dialed anything, if short-circuit reads don't apply to
+// address.
+func (br *BlockReader) attemptShortCircuit(address string) (*shortCircuitReader, net.Conn, error) {
+	sc := br.ShortCircuit
+	if !sc.isLocal(address) {
+		return nil, nil, errShortCircuitSkipped
+	}
+
+	path, err := sc.socketPath(address)
+	if err != nil {
+		return nil, nil, errShortCircuitSkipped
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, errShortCircuitSkipped
+	}
+
+	conn, err := net.DialTimeout("unix", path, connectionTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = br.writeShortCircuitRequest(conn)
+	if err == nil {
+		_, err = br.readBlockReadResponse(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, nil, errors.New("rpc: short-circuit socket is not a UnixConn")
+	}
+
+	dataFile, metaFile, err := receiveShortCircuitFds(unixConn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	stream, err := newShortCircuitReader(dataFile, metaFile, br.offset)
+	if err != nil {
+		dataFile.Close()
+		metaFile.Close()
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return stream, conn, nil
+}
+
+// A short-circuit FD request to a datanode:
+// +-----------------------------------------------------------+
+// |  Data Transfer Protocol Version, int16                    |
+// +-----------------------------------------------------------+
+// |  Op code, 1 byte (REQUEST_SHORT_CIRCUIT_FDS = 0x57)        |
+// +-----------------------------------------------------------+
+// |  varint length + OpRequestShortCircuitAccessProto          |
+// +-----------------------------------------------------------+
+func (br *BlockReader) writeShortCircuitRequest(w io.Writer) error {
+	header := []byte{0x00, dataTransferVersion, requestShortCircuitFdsOp}
+
+	op := &hdfs.OpRequestShortCircuitAccessProto{
+		Header: &hdfs.BaseHeaderProto{
+			Block: br.block.GetB(),
+			Token: br.block.GetBlockToken(),
+		},
+		MaxVersion: proto.Uint32(1),
+	}
+
+	opBytes, err := makeDelimitedMsg(op)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(header, opBytes...))
+	return err
+}
+
+// receiveShortCircuitFds reads the ancillary data a datanode sends
+// alongside its REQUEST_SHORT_CIRCUIT_FDS response: the block's data file
+// descriptor and its .meta file descriptor, passed over SCM_RIGHTS.
+func receiveShortCircuitFds(conn *net.UnixConn) (*os.File, *os.File, error) {
+	oob := make([]byte, syscall.CmsgSpace(2*4))
+	buf := make([]byte, 1)
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(scms) == 0 {
+		return nil, nil, errors.New("rpc: short-circuit response carried no ancillary data")
+	}
+
+	fds, err := syscall.ParseUnixRights(&scms[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fds) < 2 {
+		return nil, nil, errors.New("rpc: short-circuit response carried too few file descriptors")
+	}
+
+	return os.NewFile(uintptr(fds[0]), "block-data"), os.NewFile(uintptr(fds[1]), "block-meta"), nil
+}
+
+// metaHeaderSize is the length, in bytes, of a block .meta file's header:
+// a 2-byte version, a 1-byte checksum type, and a 4-byte bytes-per-checksum.
+const metaHeaderSize = 7
+
+// shortCircuitReader implements io.Reader (and io.Closer) by reading a
+// block's data file directly, chunk by chunk, verifying each chunk's CRC
+// against the matching entry in the block's .meta file. BlockReader uses
+// it as a drop-in replacement for blockReadStream when a short-circuit
+// local read succeeds.
+type shortCircuitReader struct {
+	data *os.File
+	meta *os.File
+
+	chunkSize int
+	table     *crc32.Table
+
+	// discard is the number of already-verified leading bytes of the
+	// current (first) chunk to drop, since short-circuit reads, like the
+	// TCP path, start aligned to a chunk boundary rather than the exact
+	// requested offset.
+	discard int
+
+	// offset is the absolute byte offset, within the block, of the next
+	// chunk to be read from data. It's attached to a ChecksumError so a
+	// mismatch can be reported against the right place in the block.
+	offset int64
+
+	// pending holds the verified bytes of the current chunk that didn't fit
+	// in the caller's buffer on the previous Read.
+	pending []byte
+}
+
+func newShortCircuitReader(data, meta *os.File, offset int64) (*shortCircuitReader, error) {
+	header := make([]byte, metaHeaderSize)
+	if _, err := io.ReadFull(meta, header); err != nil {
+		return nil, fmt.Errorf("rpc: reading block meta header: %s", err)
+	}
+
+	var table *crc32.Table
+	switch checksumType := header[2]; checksumType {
+	case byte(hdfs.ChecksumTypeProto_CHECKSUM_CRC32):
+		table = crc32.IEEETable
+	case byte(hdfs.ChecksumTypeProto_CHECKSUM_CRC32C):
+		table = crc32.MakeTable(crc32.Castagnoli)
+	default:
+		return nil, fmt.Errorf("rpc: unsupported checksum type in block meta: %d", checksumType)
+	}
+
+	chunkSize := int(binary.BigEndian.Uint32(header[3:metaHeaderSize]))
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("rpc: invalid chunk size in block meta: %d", chunkSize)
+	}
+
+	chunkIndex := offset / int64(chunkSize)
+	if _, err := data.Seek(chunkIndex*int64(chunkSize), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := meta.Seek(int64(metaHeaderSize)+chunkIndex*4, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &shortCircuitReader{
+		data:      data,
+		meta:      meta,
+		chunkSize: chunkSize,
+		table:     table,
+		discard:   int(offset - chunkIndex*int64(chunkSize)),
+		offset:    chunkIndex * int64(chunkSize),
+	}, nil
+}
+
+// Read implements io.Reader. It always verifies a full chunk at a time,
+// even if b is smaller than one, since the checksum only covers whole
+// chunks; the part of the chunk that doesn't fit in b is returned by the
+// next call.
+func (r *shortCircuitReader) Read(b []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(b, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+
+	for {
+		chunk := make([]byte, r.chunkSize)
+		n, err := io.ReadFull(r.data, chunk)
+		if n == 0 {
+			return 0, err
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		chunk = chunk[:n]
+
+		chunkOffset := r.offset
+		r.offset += int64(n)
+
+		var wantCRC [4]byte
+		if _, crcErr := io.ReadFull(r.meta, wantCRC[:]); crcErr != nil {
+			return 0, fmt.Errorf("rpc: reading chunk checksum: %s", crcErr)
+		}
+
+		if crc32.Checksum(chunk, r.table) != binary.BigEndian.Uint32(wantCRC[:]) {
+			return 0, &ChecksumError{ChunkOffset: chunkOffset}
+		}
+
+		if r.discard > 0 {
+			if r.discard >= len(chunk) {
+				r.discard -= len(chunk)
+				if err != nil {
+					return 0, err
+				}
+				continue
+			}
+
+			chunk = chunk[r.discard:]
+			r.discard = 0
+		}
+
+		n = copy(b, chunk)
+		r.pending = chunk[n:]
+		return n, err
+	}
+}
+
+// Close implements io.Closer.
+func (r *shortCircuitReader) Close() error {
+	r.data.Close()
+	r.meta.Close()
+	return nil
+}
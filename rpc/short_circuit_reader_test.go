@@ -0,0 +1,185 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	hdfs "github.com/colinmarc/hdfs/protocol/hadoop_hdfs"
+)
+
+const testShortCircuitChunkSize = 8
+
+// writeTestBlockFiles builds a pair of temp files standing in for a
+// datanode's block data file and its .meta file, with one CRC32 entry per
+// chunk of chunks (each expected to be exactly testShortCircuitChunkSize
+// bytes, except possibly the last).
+func writeTestBlockFiles(t *testing.T, chunks ...[]byte) (data, meta *os.File) {
+	t.Helper()
+
+	data, err := ioutil.TempFile("", "short-circuit-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err = ioutil.TempFile("", "short-circuit-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		data.Close()
+		meta.Close()
+		os.Remove(data.Name())
+		os.Remove(meta.Name())
+	})
+
+	header := make([]byte, metaHeaderSize)
+	header[2] = byte(hdfs.ChecksumTypeProto_CHECKSUM_CRC32)
+	binary.BigEndian.PutUint32(header[3:metaHeaderSize], testShortCircuitChunkSize)
+	if _, err := meta.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunk := range chunks {
+		if _, err := data.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk))
+		if _, err := meta.Write(crc[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := meta.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	return data, meta
+}
+
+func TestShortCircuitReaderReadsChunkAlignedBlock(t *testing.T) {
+	data, meta := writeTestBlockFiles(t, []byte("abcdefgh"), []byte("ijklmnop"))
+
+	r, err := newShortCircuitReader(data, meta, 0)
+	if err != nil {
+		t.Fatalf("newShortCircuitReader: %s", err)
+	}
+	defer r.Close()
+
+	buf := make([]byte, testShortCircuitChunkSize)
+
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("first Read: %s", err)
+	}
+	if got := string(buf[:n]); got != "abcdefgh" {
+		t.Errorf("first Read = %q, want %q", got, "abcdefgh")
+	}
+
+	n, err = r.Read(buf)
+	if err != nil {
+		t.Fatalf("second Read: %s", err)
+	}
+	if got := string(buf[:n]); got != "ijklmnop" {
+		t.Errorf("second Read = %q, want %q", got, "ijklmnop")
+	}
+
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Errorf("Read past the end of the block = %v, want io.EOF", err)
+	}
+}
+
+func TestShortCircuitReaderSeeksToChunkContainingOffset(t *testing.T) {
+	data, meta := writeTestBlockFiles(t, []byte("abcdefgh"), []byte("ijklmnop"))
+
+	// offset 8 is the start of the second chunk, so newShortCircuitReader
+	// should seek both files past the first chunk entirely, with nothing
+	// to discard.
+	r, err := newShortCircuitReader(data, meta, 8)
+	if err != nil {
+		t.Fatalf("newShortCircuitReader: %s", err)
+	}
+	defer r.Close()
+
+	if r.discard != 0 {
+		t.Errorf("discard = %d, want 0", r.discard)
+	}
+
+	buf := make([]byte, testShortCircuitChunkSize)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if got := string(buf[:n]); got != "ijklmnop" {
+		t.Errorf("Read = %q, want %q", got, "ijklmnop")
+	}
+}
+
+func TestShortCircuitReaderDiscardsLeadingBytesOfUnalignedOffset(t *testing.T) {
+	data, meta := writeTestBlockFiles(t, []byte("abcdefgh"), []byte("ijklmnop"))
+
+	// offset 3 falls 3 bytes into the first chunk; the reader still reads
+	// (and verifies) the whole chunk, but should only hand back the bytes
+	// from the requested offset onward.
+	r, err := newShortCircuitReader(data, meta, 3)
+	if err != nil {
+		t.Fatalf("newShortCircuitReader: %s", err)
+	}
+	defer r.Close()
+
+	if r.discard != 3 {
+		t.Errorf("discard = %d, want 3", r.discard)
+	}
+
+	buf := make([]byte, testShortCircuitChunkSize)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if got := string(buf[:n]); got != "defgh" {
+		t.Errorf("Read = %q, want %q", got, "defgh")
+	}
+}
+
+func TestShortCircuitReaderChecksumMismatch(t *testing.T) {
+	data, meta := writeTestBlockFiles(t, []byte("abcdefgh"), []byte("ijklmnop"))
+
+	// Corrupt the second chunk's stored CRC so it no longer matches its
+	// data.
+	if _, err := meta.Seek(int64(metaHeaderSize+4), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := meta.Write([]byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := meta.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newShortCircuitReader(data, meta, 0)
+	if err != nil {
+		t.Fatalf("newShortCircuitReader: %s", err)
+	}
+	defer r.Close()
+
+	buf := make([]byte, testShortCircuitChunkSize)
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("first (good) chunk: %s", err)
+	}
+
+	_, err = r.Read(buf)
+	cerr, ok := err.(*ChecksumError)
+	if !ok {
+		t.Fatalf("Read error = %v (%T), want *ChecksumError", err, err)
+	}
+	if cerr.ChunkOffset != testShortCircuitChunkSize {
+		t.Errorf("ChunkOffset = %d, want %d", cerr.ChunkOffset, testShortCircuitChunkSize)
+	}
+}